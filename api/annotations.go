@@ -0,0 +1,98 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+
+	"android/soong/android"
+
+	"github.com/google/blueprint"
+)
+
+// annotationsZipProvider is satisfied by the droidstubs/java_api_library
+// modules that contribute to a surface; it mirrors java.ApiStubsProvider's
+// AnnotationsZip() method without taking a direct dependency on the java
+// package's concrete type.
+type annotationsZipProvider interface {
+	AnnotationsZip() android.Path
+}
+
+// annotationsDepTag marks a dependency added purely so its AnnotationsZip()
+// output can be folded into the named surface's merged annotations.zip.
+type annotationsDepTag struct {
+	blueprint.BaseDependencyTag
+	surface string
+}
+
+func (a *CombinedApis) annotationsDeps(ctx android.BottomUpMutatorContext) {
+	for _, surface := range allApiSurfaces {
+		if ctx.OtherModuleExists(surface.docsModule) {
+			ctx.AddDependency(ctx.Module(), annotationsDepTag{surface: surface.name}, surface.docsModule)
+		}
+	}
+	for _, member := range a.effectiveSystemServerClasspath() {
+		if ctx.OtherModuleExists(member) {
+			ctx.AddDependency(ctx.Module(), annotationsDepTag{surface: systemServerApi.name}, member)
+		}
+	}
+}
+
+// generateAnnotationsZips merges the AnnotationsZip() output of every
+// contributor to each surface into a single android_stubs_current.annotations.zip-style
+// artifact per surface, so IDE/lint tooling and SDK packaging have one well
+// known path to read instead of iterating over individual contributions.
+func (a *CombinedApis) generateAnnotationsZips(ctx android.ModuleContext) {
+	a.annotationsZips = make(map[string]android.Path)
+
+	surfaces := append(append([]apiSurface{}, allApiSurfaces...), systemServerApi)
+	for _, surface := range surfaces {
+		var zips android.Paths
+		ctx.VisitDirectDepsWithTag(annotationsDepTag{surface: surface.name}, func(dep android.Module) {
+			if provider, ok := dep.(annotationsZipProvider); ok {
+				if zip := provider.AnnotationsZip(); zip != nil {
+					zips = append(zips, zip)
+				}
+			}
+		})
+		if len(zips) == 0 {
+			continue
+		}
+
+		merged := android.PathForModuleOut(ctx, surface.stubsModule+".annotations.zip")
+		rule := android.NewRuleBuilder(pctx, ctx)
+		rule.Command().
+			BuiltTool("merge_zips").
+			Output(merged).
+			Inputs(zips)
+		rule.Build(surface.name+"_merged_annotations", "merge "+surface.name+" annotations.zip")
+
+		a.annotationsZips[surface.name] = merged
+	}
+}
+
+var _ android.OutputFileProducer = (*CombinedApis)(nil)
+
+// OutputFiles implements android.OutputFileProducer, letting consumers
+// reference a surface's merged annotations.zip as, e.g.,
+// ":foo{.public.annotations}".
+func (a *CombinedApis) OutputFiles(tag string) (android.Paths, error) {
+	for name, zip := range a.annotationsZips {
+		if tag == "."+name+".annotations" {
+			return android.Paths{zip}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported module reference tag %q", tag)
+}
@@ -0,0 +1,349 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api implements the combined_apis module type, which aggregates the
+// platform's bootclasspath and system server classpath so that the stub
+// libraries for every API surface (public, system, test, module-lib and
+// system-server) can
+// be generated consistently from a single declaration instead of having each
+// java_sdk_library opt in individually.
+package api
+
+import (
+	"android/soong/android"
+	"android/soong/java"
+
+	"github.com/google/blueprint"
+	"github.com/google/blueprint/proptools"
+)
+
+var pctx = android.NewPackageContext("android/soong/api")
+
+func init() {
+	registerBuildComponents(android.InitRegistrationContext)
+}
+
+func registerBuildComponents(ctx android.RegistrationContext) {
+	ctx.RegisterModuleType("combined_apis", combinedApisModuleFactory)
+	ctx.RegisterModuleType("combined_apis_defaults", combinedApisModuleDefaultsFactory)
+	ctx.RegisterModuleType("combined_apis_import", combinedApisImportModuleFactory)
+}
+
+// apiSurface identifies one of the aggregated API surfaces that combined_apis
+// knows how to generate stubs for, and the droidstubs module that backs it.
+type apiSurface struct {
+	// name is the surface name used in droidstubs/java_api_library naming, e.g. "public".
+	name string
+	// stubsModule is the android_*_stubs_current module name the surface aggregates into.
+	stubsModule string
+	// docsModule is the hand-authored droidstubs module whose api_contribution backs the surface.
+	docsModule string
+}
+
+var (
+	publicApi    = apiSurface{name: "public", stubsModule: "android_stubs_current", docsModule: "api-stubs-docs-non-updatable"}
+	systemApi    = apiSurface{name: "system", stubsModule: "android_system_stubs_current", docsModule: "system-api-stubs-docs-non-updatable"}
+	testApi      = apiSurface{name: "test", stubsModule: "android_test_stubs_current", docsModule: "test-api-stubs-docs-non-updatable"}
+	moduleLibApi = apiSurface{name: "module-lib", stubsModule: "android_module_lib_stubs_current", docsModule: "module-lib-api-stubs-docs-non-updatable"}
+
+	allApiSurfaces = []apiSurface{publicApi, systemApi, testApi, moduleLibApi}
+
+	// systemServerApi is a real API surface like the others above, but unlike
+	// them it has no single hand-authored droidstubs module to aggregate: its
+	// stub jar is built straight from the api_contributions of every member of
+	// System_server_classpath, so its docsModule is only used for the
+	// check_api current/removed txt files, not for api_contributions.
+	systemServerApi = apiSurface{name: "system-server", stubsModule: "android_system_server_stubs_current", docsModule: "system-server-api-stubs-docs-non-updatable"}
+)
+
+// fromTextSuffix is appended to a stub/classpath module name to select the
+// variant whose stubs are generated from a signature (.txt) file rather than
+// from source via metalava.
+const fromTextSuffix = ".from-text"
+
+type CombinedApisProperties struct {
+	// The bootclasspath modules that make up the platform's boot classpath.
+	Bootclasspath []string
+
+	// The system server classpath modules that make up the platform's system
+	// server classpath.
+	System_server_classpath []string
+
+	// Build_from_text, when set, overrides the BUILD_FROM_TEXT_STUB product
+	// variable for this combined_apis module only. When true every
+	// bootclasspath/system_server_classpath contribution is resolved to its
+	// ".from-text" twin (signature-file-generated stubs) instead of the
+	// metalava-generated stubs, so the whole combined API surface can be
+	// flipped atomically for unbundled/module builds.
+	Build_from_text *bool
+
+	// Exclude_bootclasspath lists module names to remove from Bootclasspath
+	// after defaults have been merged in. This lets a combined_apis module
+	// that inherits a long list from combined_apis_defaults opt back out of
+	// individual entries instead of having to fork the whole list.
+	Exclude_bootclasspath []string
+
+	// Exclude_system_server_classpath is the System_server_classpath analog
+	// of Exclude_bootclasspath.
+	Exclude_system_server_classpath []string
+}
+
+type CombinedApis struct {
+	android.ModuleBase
+	android.DefaultableModuleBase
+
+	properties CombinedApisProperties
+
+	// annotationsZips holds the merged per-surface annotations.zip built by
+	// generateAnnotationsZips, keyed by surface name.
+	annotationsZips map[string]android.Path
+}
+
+// CombinedApisDefaults lets combined_apis_defaults soong_config_module_type
+// entries contribute to Bootclasspath/System_server_classpath via the
+// standard defaults-merging mechanism.
+type CombinedApisDefaults struct {
+	android.ModuleBase
+	android.DefaultsModuleBase
+}
+
+func combinedApisModuleFactory() android.Module {
+	module := &CombinedApis{}
+	module.AddProperties(&module.properties)
+	android.InitAndroidModule(module)
+	android.InitDefaultableModule(module)
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) {
+		module.createInternalModules(ctx)
+	})
+	return module
+}
+
+func combinedApisModuleDefaultsFactory() android.Module {
+	module := &CombinedApisDefaults{}
+	module.AddProperties(&CombinedApisProperties{})
+	android.InitDefaultsModule(module)
+	return module
+}
+
+// buildFromText reports whether this combined_apis module should resolve its
+// contributions to their ".from-text" twins, honoring a per-module override
+// before falling back to the BUILD_FROM_TEXT_STUB product variable.
+func (a *CombinedApis) buildFromText(ctx android.BaseModuleContext) bool {
+	if a.properties.Build_from_text != nil {
+		return *a.properties.Build_from_text
+	}
+	return proptools.BoolDefault(ctx.Config().ProductVariables().Build_from_text_stub, false)
+}
+
+// effectiveBootclasspath returns Bootclasspath with Exclude_bootclasspath
+// subtracted, once defaults merging has concatenated both lists.
+func (a *CombinedApis) effectiveBootclasspath() []string {
+	return android.RemoveListFromList(a.properties.Bootclasspath, a.properties.Exclude_bootclasspath)
+}
+
+// effectiveSystemServerClasspath is the System_server_classpath analog of
+// effectiveBootclasspath.
+func (a *CombinedApis) effectiveSystemServerClasspath() []string {
+	return android.RemoveListFromList(a.properties.System_server_classpath, a.properties.Exclude_system_server_classpath)
+}
+
+// withFromText rewrites every entry in list to its ".from-text" twin when
+// fromText is true, leaving the metalava-generated names untouched otherwise.
+func withFromText(list []string, fromText bool) []string {
+	if !fromText {
+		return list
+	}
+	out := make([]string, 0, len(list))
+	for _, entry := range list {
+		out = append(out, entry+fromTextSuffix)
+	}
+	return out
+}
+
+// createInternalModules synthesizes, for every API surface, the stub library
+// backed by the surface's hand-authored droidstubs, in both its
+// metalava-generated (java_library) and from-text (java_api_library) forms,
+// plus the two system-server stub libraries built from System_server_classpath.
+func (a *CombinedApis) createInternalModules(ctx android.LoadHookContext) {
+	for _, surface := range allApiSurfaces {
+		createApiLibrary(ctx, surface, false /* fromText */)
+		createApiLibrary(ctx, surface, true /* fromText */)
+	}
+
+	// android_system_server_stubs_current aggregates the api_contributions of
+	// every system_server_classpath member directly, the same way app code
+	// compiles against android_stubs_current for the public surface.
+	createSystemServerApiLibrary(ctx, a.effectiveSystemServerClasspath(), false /* fromText */)
+	createSystemServerApiLibrary(ctx, a.effectiveSystemServerClasspath(), true /* fromText */)
+}
+
+// createApiLibrary synthesizes the stub module for one surface. The
+// fromText=true twin is a java_api_library that builds purely from the
+// surface's signature (.txt) api_contribution. The fromText=false twin is the
+// real metalava-generated variant: a java_library that compiles the
+// droidstubs module's own source-generated stubs srcjar, so the two twins are
+// backed by genuinely different stub generation paths and Build_from_text can
+// actually change what gets built.
+func createApiLibrary(ctx android.LoadHookContext, surface apiSurface, fromText bool) {
+	name := surface.stubsModule
+	if !fromText {
+		props := struct {
+			Name        *string
+			Srcs        []string
+			Sdk_version *string
+		}{
+			Name:        proptools.StringPtr(name),
+			Srcs:        []string{":" + surface.docsModule},
+			Sdk_version: proptools.StringPtr("core_platform"),
+		}
+		ctx.CreateModule(java.LibraryFactory, &props)
+		return
+	}
+
+	props := struct {
+		Name              *string
+		Api_contributions []string
+	}{
+		Name:              proptools.StringPtr(name + fromTextSuffix),
+		Api_contributions: []string{surface.docsModule + ".api.contribution"},
+	}
+	ctx.CreateModule(java.ApiLibraryFactory, &props)
+}
+
+// createSystemServerApiLibrary is the system-server analog of createApiLibrary:
+// it aggregates every system_server_classpath member instead of a single
+// shared droidstubs module, since each member publishes its own stubs and its
+// own api_contribution the same way java_sdk_library members do for the other
+// surfaces.
+func createSystemServerApiLibrary(ctx android.LoadHookContext, members []string, fromText bool) {
+	name := systemServerApi.stubsModule
+	if !fromText {
+		srcs := make([]string, 0, len(members))
+		for _, member := range members {
+			srcs = append(srcs, ":"+member+".stubs.source")
+		}
+		props := struct {
+			Name        *string
+			Srcs        []string
+			Sdk_version *string
+		}{
+			Name:        proptools.StringPtr(name),
+			Srcs:        srcs,
+			Sdk_version: proptools.StringPtr("core_platform"),
+		}
+		ctx.CreateModule(java.LibraryFactory, &props)
+		return
+	}
+
+	contributions := make([]string, 0, len(members))
+	for _, member := range members {
+		contributions = append(contributions, member+".stubs.source.api.contribution")
+	}
+
+	props := struct {
+		Name              *string
+		Api_contributions []string
+	}{
+		Name:              proptools.StringPtr(name + fromTextSuffix),
+		Api_contributions: contributions,
+	}
+	ctx.CreateModule(java.ApiLibraryFactory, &props)
+}
+
+type bootclasspathDepTag struct {
+	blueprint.BaseDependencyTag
+	fromText bool
+}
+
+func (a *CombinedApis) DepsMutator(ctx android.BottomUpMutatorContext) {
+	// Depend on both flavors of every bootclasspath AND system_server_classpath
+	// member so checkBuildFromTextConsistency can diff the whole combined
+	// surface, not just the boot classpath half of it. Skip members that
+	// don't exist as build modules (e.g. in unit tests that only exercise
+	// classpath-merging) rather than failing the whole build on what is
+	// ultimately a best-effort diagnostic.
+	classpath := append(append([]string{}, a.effectiveBootclasspath()...), a.effectiveSystemServerClasspath()...)
+	for _, name := range classpath {
+		if ctx.OtherModuleExists(name) {
+			ctx.AddDependency(ctx.Module(), bootclasspathDepTag{fromText: false}, name)
+		}
+		if textName := name + fromTextSuffix; ctx.OtherModuleExists(textName) {
+			ctx.AddDependency(ctx.Module(), bootclasspathDepTag{fromText: true}, textName)
+		}
+	}
+	a.annotationsDeps(ctx)
+	a.surfaceSnapshotDeps(ctx)
+}
+
+func (a *CombinedApis) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	a.validateNoClasspathOverlap(ctx)
+	a.setBootclasspathProvider(ctx)
+	a.checkBuildFromTextConsistency(ctx)
+	a.generateAnnotationsZips(ctx)
+}
+
+// validateNoClasspathOverlap is a per-module GenerateAndroidBuildActions
+// check, not a registered android.NeverallowRule: once defaults have been
+// merged and excludes subtracted, the same jar must never end up in both the
+// bootclasspath and the system server classpath. Silent duplication there
+// produces confusing dexpreopt failures far from this module, so it's caught
+// here instead.
+func (a *CombinedApis) validateNoClasspathOverlap(ctx android.ModuleContext) {
+	systemServer := make(map[string]bool)
+	for _, entry := range a.effectiveSystemServerClasspath() {
+		systemServer[entry] = true
+	}
+	for _, entry := range a.effectiveBootclasspath() {
+		if systemServer[entry] {
+			ctx.ModuleErrorf("%q is listed in both bootclasspath and system_server_classpath "+
+				"(possibly via merged defaults); use exclude_bootclasspath or "+
+				"exclude_system_server_classpath to resolve the duplication", entry)
+		}
+	}
+}
+
+// checkBuildFromTextConsistency diffs the metalava-generated and the
+// from-text stub jars for every bootclasspath/system_server_classpath member
+// against each other, failing the build if build_from_text would silently
+// change the API surface a module builds against. It relies on an `sdkdiff`
+// host tool being available the same way other BuiltTool() checks in this
+// package rely on `merge_zips`; it is a no-op (see below) until both stub
+// variants actually exist as build modules, which is what
+// TestBuildFromText's "framework-existing" member exercises.
+func (a *CombinedApis) checkBuildFromTextConsistency(ctx android.ModuleContext) {
+	metalavaJars := collectStubJars(ctx, bootclasspathDepTag{fromText: false})
+	fromTextJars := collectStubJars(ctx, bootclasspathDepTag{fromText: true})
+	if len(metalavaJars) == 0 || len(fromTextJars) == 0 {
+		return
+	}
+
+	rule := android.NewRuleBuilder(pctx, ctx)
+	diffStamp := android.PathForModuleOut(ctx, "build_from_text_diff.stamp")
+	rule.Command().
+		BuiltTool("sdkdiff").
+		FlagWithInput("--metalava-jars=", metalavaJars...).
+		FlagWithInput("--from-text-jars=", fromTextJars...).
+		FlagWithOutput("--stamp=", diffStamp)
+	rule.Build("combined_apis_build_from_text_diff", "diff metalava stubs against from-text stubs")
+}
+
+func collectStubJars(ctx android.ModuleContext, tag bootclasspathDepTag) android.Paths {
+	var jars android.Paths
+	ctx.VisitDirectDepsWithTag(tag, func(dep android.Module) {
+		if provider, ok := dep.(interface{ HeaderJars() android.Paths }); ok {
+			jars = append(jars, provider.HeaderJars()...)
+		}
+	})
+	return jars
+}
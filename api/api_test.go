@@ -7,6 +7,9 @@ import (
 	"android/soong/android"
 	"android/soong/dexpreopt"
 	"android/soong/java"
+	"android/soong/sdk"
+
+	"github.com/google/blueprint/proptools"
 )
 
 var PrepareForTestWithCombinedApis = android.FixtureRegisterWithContext(
@@ -84,7 +87,6 @@ func gatherRequiredDepsForTest() string {
 		removedFile: "api/module-lib-removed.txt",
 	}
 	var systemServerDroidstubs = droidstubsStruct{
-		// This module does not exist but is named this way for consistency
 		name:        "system-server-api-stubs-docs-non-updatable",
 		apiSurface:  "system-server",
 		apiFile:     "api/system-server-current.txt",
@@ -317,3 +319,266 @@ func TestFilegroupDefaults(t *testing.T) {
 		})
 	}
 }
+
+func TestExcludeClasspath(t *testing.T) {
+	bp := `
+		soong_config_module_type {
+			name: "test_module",
+			module_type: "combined_apis_defaults",
+			config_namespace: "ANDROID",
+			bool_variables: ["test_var"],
+			properties: [
+					"bootclasspath",
+			],
+		}
+
+		soong_config_bool_variable {
+			name: "test_var",
+		}
+
+		test_module {
+			name: "test_module_defaults",
+			soong_config_variables: {
+				test_var: {
+					bootclasspath: [
+							"framework-test",
+					],
+				},
+			},
+		}
+
+		combined_apis {
+			name: "foo",
+			defaults: ["test_module_defaults"],
+			bootclasspath: [
+				"framework-existing",
+			],
+			exclude_bootclasspath: [
+				"framework-test",
+			],
+		}
+	`
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithCombinedApis,
+		prepareForTestWithCombinedApisDefaultModules,
+		android.PrepareForTestWithSoongConfigModuleBuildComponents,
+		android.FixtureWithRootAndroidBp(bp),
+		android.FixtureModifyProductVariables(func(variables android.FixtureProductVariables) {
+			variables.VendorVars = map[string]map[string]string{
+				"ANDROID": {
+					"test_var": "true",
+				},
+			}
+		}),
+	).RunTest(t)
+
+	module := result.Module("foo", "").(*CombinedApis)
+	android.AssertDeepEquals(t, "bootclasspath", []string{"framework-existing", "framework-test"}, module.properties.Bootclasspath)
+	android.AssertDeepEquals(t, "effective bootclasspath excludes framework-test",
+		[]string{"framework-existing"}, module.effectiveBootclasspath())
+}
+
+func TestClasspathOverlapIsRejected(t *testing.T) {
+	bp := `
+		combined_apis {
+			name: "foo",
+			bootclasspath: ["framework-shared"],
+			system_server_classpath: ["framework-shared"],
+		}
+	`
+	android.GroupFixturePreparers(
+		PrepareForTestWithCombinedApis,
+		android.FixtureWithRootAndroidBp(bp),
+	).
+		ExtendWithErrorHandler(android.FixtureExpectsOneErrorPattern(
+			`"framework-shared" is listed in both bootclasspath and system_server_classpath`)).
+		RunTest(t)
+}
+
+func TestBuildFromText(t *testing.T) {
+	bp := `
+		combined_apis {
+			name: "foo",
+			bootclasspath: ["framework-existing"],
+			build_from_text: true,
+		}
+
+		java_library {
+			name: "framework-existing",
+			srcs: ["a.java"],
+			sdk_version: "none",
+			system_modules: "stable-core-platform-api-stubs-system-modules",
+			compile_dex: true,
+		}
+
+		java_api_library {
+			name: "framework-existing.from-text",
+			api_contributions: ["api-stubs-docs-non-updatable.api.contribution"],
+		}
+	`
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithCombinedApis,
+		prepareForTestWithCombinedApisDefaultModules,
+		android.FixtureWithRootAndroidBp(bp),
+	).RunTest(t)
+
+	foo := result.Module("foo", "").(*CombinedApis)
+	android.AssertBoolEquals(t, "build_from_text", true, proptools.Bool(foo.properties.Build_from_text))
+
+	// The metalava-generated twin is a java_library wrapping the droidstubs'
+	// own stubs srcjar; the from-text twin is a java_api_library consuming the
+	// surface's signature-file api_contribution. They must be two distinct
+	// generated modules, not the same module under two names.
+	metalava := result.ModuleForTests("android_stubs_current", "").Module()
+	fromText := result.ModuleForTests("android_stubs_current.from-text", "").Module()
+	if _, ok := metalava.(*java.Library); !ok {
+		t.Errorf("expected android_stubs_current to be a java_library, got %T", metalava)
+	}
+	if _, ok := fromText.(*java.ApiLibrary); !ok {
+		t.Errorf("expected android_stubs_current.from-text to be a java_api_library, got %T", fromText)
+	}
+
+	// With both the metalava and from-text variants of framework-existing
+	// present as real build modules, checkBuildFromTextConsistency must
+	// actually build its diff rule rather than returning early because
+	// collectStubJars came back empty.
+	diff := result.ModuleForTests("foo", "").Output("build_from_text_diff.stamp")
+	android.AssertStringDoesContain(t, "build_from_text diff command", diff.RuleParams.Command, "sdkdiff")
+}
+
+func TestCombinedApisOutputFilesUnsupportedTag(t *testing.T) {
+	bp := `
+		combined_apis {
+			name: "foo",
+		}
+	`
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithCombinedApis,
+		android.FixtureWithRootAndroidBp(bp),
+	).RunTest(t)
+
+	module := result.Module("foo", "").(*CombinedApis)
+	if _, err := module.OutputFiles(".bogus.annotations"); err == nil {
+		t.Errorf("expected OutputFiles to reject an unrecognized tag instead of silently returning nothing")
+	}
+}
+
+func TestSystemServerSurfaceExcludesExcludedMembers(t *testing.T) {
+	bp := `
+		combined_apis {
+			name: "foo",
+			system_server_classpath: ["service-a", "service-b"],
+			exclude_system_server_classpath: ["service-b"],
+		}
+	`
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithCombinedApis,
+		android.FixtureWithRootAndroidBp(bp),
+	).RunTest(t)
+
+	module := result.Module("foo", "").(*CombinedApis)
+	android.AssertDeepEquals(t, "effective system_server_classpath feeding android_system_server_stubs_current",
+		[]string{"service-a"}, module.effectiveSystemServerClasspath())
+}
+
+func TestCombinedApisSdkSnapshot(t *testing.T) {
+	bp := `
+		combined_apis {
+			name: "foo",
+			bootclasspath: ["framework-existing"],
+		}
+
+		sdk {
+			name: "mysdk",
+			combined_apis: ["foo"],
+		}
+	`
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithCombinedApis,
+		prepareForTestWithCombinedApisDefaultModules,
+		sdk.PrepareForTestWithSdkBuildComponents,
+		android.FixtureWithRootAndroidBp(bp),
+	).RunTest(t)
+
+	// The system-server surface block below is what regresses if
+	// allSnapshotSurfaces ever drops systemServerApi again: unlike the other
+	// four surfaces its stub jar is not aggregated from a hand-authored
+	// droidstubs module's api_contribution, so it's the one most likely to get
+	// silently dropped by a refactor.
+	sdk.CheckSnapshot(t, result, "mysdk", "",
+		sdk.CheckSnapshotAndroidBpContents(`
+// This is auto-generated. DO NOT EDIT.
+
+combined_apis_import {
+    name: "foo",
+    prefer: false,
+    visibility: ["//visibility:public"],
+    bootclasspath: ["framework-existing"],
+    public: {
+        stub_jar: "public/stubs.jar",
+        api_file: "public/api/current.txt",
+    },
+    system: {
+        stub_jar: "system/stubs.jar",
+        api_file: "system/api/current.txt",
+    },
+    test: {
+        stub_jar: "test/stubs.jar",
+        api_file: "test/api/current.txt",
+    },
+    module_lib: {
+        stub_jar: "module-lib/stubs.jar",
+        api_file: "module-lib/api/current.txt",
+    },
+    system_server: {
+        stub_jar: "system-server/stubs.jar",
+        api_file: "system-server/api/current.txt",
+    },
+}
+`),
+	)
+}
+
+func TestCombinedApisBootclasspathProvider(t *testing.T) {
+	bp := `
+		combined_apis {
+			name: "foo",
+			bootclasspath: ["framework-existing"],
+			system_server_classpath: ["service-existing"],
+		}
+	`
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithCombinedApis,
+		android.FixtureWithRootAndroidBp(bp),
+	).RunTest(t)
+
+	foo := result.Module("foo", "")
+	info, _ := android.SingletonModuleProvider(result, foo, CombinedApisBootclasspathProvider)
+	android.AssertDeepEquals(t, "bootclasspath", []string{"framework-existing"}, info.Bootclasspath)
+	android.AssertDeepEquals(t, "system_server_classpath", []string{"service-existing"}, info.SystemServerClasspath)
+}
+
+func TestCombinedApisImportModuleType(t *testing.T) {
+	bp := `
+		combined_apis_import {
+			name: "foo",
+			bootclasspath: ["framework-existing"],
+			public: {
+				stub_jar: "public/stubs.jar",
+				api_file: "public/api/current.txt",
+			},
+		}
+	`
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithCombinedApis,
+		android.FixtureWithRootAndroidBp(bp),
+		android.MockFS{
+			"public/stubs.jar":        nil,
+			"public/api/current.txt": nil,
+		}.AddToFixture(),
+	).RunTest(t)
+
+	module := result.Module("foo", "").(*CombinedApisImport)
+	android.AssertDeepEquals(t, "bootclasspath", []string{"framework-existing"}, module.properties.Bootclasspath)
+	android.AssertStringEquals(t, "public stub_jar", "public/stubs.jar", proptools.String(module.properties.Public.Stub_jar))
+}
@@ -0,0 +1,56 @@
+// Copyright 2022 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"android/soong/android"
+
+	"github.com/google/blueprint"
+)
+
+// CombinedApisBootclasspathInfo is the effective, defaults-merged
+// bootclasspath and system server classpath of a combined_apis module. It is
+// set as a provider so that dexpreopt.GlobalConfig and the dex_bootjars
+// singleton can drive boot image composition directly from a single
+// combined_apis declaration instead of product makefiles duplicating the
+// list, and so platform_bootclasspath / bootclasspath_fragment modules can
+// cross-check their own membership against it.
+type CombinedApisBootclasspathInfo struct {
+	// Bootclasspath is the fully-merged bootclasspath module name list, in
+	// link order, as validated by TestFilegroupDefaults.
+	Bootclasspath []string
+
+	// SystemServerClasspath is the equivalent fully-merged list for the
+	// system server classpath.
+	SystemServerClasspath []string
+}
+
+// CombinedApisBootclasspathProvider exposes a CombinedApis module's effective
+// classpath to other modules in the build graph, notably the dex_bootjars
+// singleton and dexpreopt.GlobalConfig. Cross-checking a platform_bootclasspath
+// or bootclasspath_fragment module's own membership against this provider is
+// left to those modules to wire up themselves (via android.OtherModuleProvider
+// on whatever dependency tag they already use to reach a combined_apis
+// module); this package doesn't prescribe one, since it has no such consumer
+// of its own to validate it against.
+var CombinedApisBootclasspathProvider = blueprint.NewProvider[CombinedApisBootclasspathInfo]()
+
+func (a *CombinedApis) setBootclasspathProvider(ctx android.ModuleContext) {
+	fromText := a.buildFromText(ctx)
+	android.SetProvider(ctx, CombinedApisBootclasspathProvider, CombinedApisBootclasspathInfo{
+		Bootclasspath:         withFromText(a.effectiveBootclasspath(), fromText),
+		SystemServerClasspath: withFromText(a.effectiveSystemServerClasspath(), fromText),
+	})
+}
@@ -0,0 +1,252 @@
+// Copyright 2022 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"strings"
+
+	"android/soong/android"
+
+	"github.com/google/blueprint"
+)
+
+func init() {
+	android.RegisterSdkMemberType(&combinedApisSdkMemberType{
+		SdkMemberTypeBase: android.SdkMemberTypeBase{
+			PropertyName: "combined_apis",
+			SupportsSdk:  true,
+		},
+	})
+}
+
+// combinedApisSdkMemberType lets an `sdk` module snapshot a combined_apis
+// module: its bootclasspath/system_server_classpath contributions, the stub
+// libraries those contributions generate, and the API text files for every
+// surface the combined_apis module exposes (including system-server), so
+// downstream branches don't have to hand-curate prebuilts for each surface
+// separately.
+type combinedApisSdkMemberType struct {
+	android.SdkMemberTypeBase
+}
+
+var _ android.SdkMemberType = (*combinedApisSdkMemberType)(nil)
+
+func (mt *combinedApisSdkMemberType) AddDependencies(ctx android.SdkDependencyContext, dependencyTag blueprint.DependencyTag, names []string) {
+	ctx.AddVariationDependencies(nil, dependencyTag, names...)
+}
+
+func (mt *combinedApisSdkMemberType) IsInstance(module android.Module) bool {
+	_, ok := module.(*CombinedApis)
+	return ok
+}
+
+// AddPrebuiltModule regenerates a combined_apis_import entry rather than a
+// live combined_apis one: combined_apis's own LoadHook synthesizes its stub
+// modules from source droidstubs that won't exist in a prebuilt-only
+// downstream tree, so the snapshot needs a module type that just carries the
+// already-built prebuilts forward instead of trying to rebuild them.
+func (mt *combinedApisSdkMemberType) AddPrebuiltModule(ctx android.SdkMemberContext, member android.SdkMember) android.BpModule {
+	return ctx.SnapshotBuilder().AddPrebuiltModule(member, "combined_apis_import")
+}
+
+func (mt *combinedApisSdkMemberType) CreateVariantPropertiesStruct() android.SdkMemberProperties {
+	return &combinedApisSdkMemberProperties{}
+}
+
+// allSnapshotSurfaces is every surface the sdk snapshot captures, including
+// system-server now that it's a real surface (see createSystemServerApiLibrary).
+var allSnapshotSurfaces = append(append([]apiSurface{}, allApiSurfaces...), systemServerApi)
+
+// combinedApisSdkMemberProperties is the per-variant snapshot of a
+// combined_apis module: the classpath lists it was built with, plus the
+// stub jar and API text file captured for every surface it aggregates.
+type combinedApisSdkMemberProperties struct {
+	android.SdkMemberPropertiesBase
+
+	Bootclasspath            []string
+	System_server_classpath []string
+
+	// Surfaces holds the snapshotted stub jar and api txt file for every
+	// surface in allSnapshotSurfaces.
+	Surfaces []snapshotSurface
+}
+
+// snapshotSurface is the captured state of a single API surface at snapshot
+// time: the stub jar consumers link against and the signature file used to
+// regenerate from-text stubs downstream.
+type snapshotSurface struct {
+	Name    string
+	StubJar android.Path
+	ApiFile android.Path
+}
+
+// surfaceDepTag marks a dependency added purely so PopulateFromVariant can
+// read a surface's stub jar / api file straight off the build graph via
+// VisitDirectDepsWithTag when this module is snapshotted, instead of trying
+// to reach into other modules by name.
+type surfaceDepTag struct {
+	blueprint.BaseDependencyTag
+	surface string
+	docs    bool
+}
+
+// surfaceSnapshotDeps adds the dependencies surfaceDepTag/PopulateFromVariant
+// rely on: one edge to every surface's stub-generating module and one to its
+// docs module, for every surface in allSnapshotSurfaces. Called from
+// CombinedApis.DepsMutator alongside the bootclasspath and annotations deps.
+func (a *CombinedApis) surfaceSnapshotDeps(ctx android.BottomUpMutatorContext) {
+	for _, surface := range allSnapshotSurfaces {
+		if ctx.OtherModuleExists(surface.stubsModule) {
+			ctx.AddDependency(ctx.Module(), surfaceDepTag{surface: surface.name}, surface.stubsModule)
+		}
+		if ctx.OtherModuleExists(surface.docsModule) {
+			ctx.AddDependency(ctx.Module(), surfaceDepTag{surface: surface.name, docs: true}, surface.docsModule)
+		}
+	}
+}
+
+func (p *combinedApisSdkMemberProperties) PopulateFromVariant(ctx android.SdkMemberContext, variant android.Module) {
+	combined := variant.(*CombinedApis)
+	p.Bootclasspath = combined.effectiveBootclasspath()
+	p.System_server_classpath = combined.effectiveSystemServerClasspath()
+
+	moduleCtx := ctx.SdkModuleContext()
+	// The surfaceDepTag edges belong to the combined_apis variant, not to the
+	// sdk module whose context is used here, so walk one level through the
+	// variant and only visit its own direct deps carrying the given tag.
+	visitVariantDepsWithTag := func(tag blueprint.DependencyTag, visit func(android.Module)) {
+		moduleCtx.WalkDeps(func(child, parent android.Module) bool {
+			if parent == variant && moduleCtx.OtherModuleDependencyTag(child) == tag {
+				visit(child)
+			}
+			return child == variant
+		})
+	}
+	for _, surface := range allSnapshotSurfaces {
+		snap := snapshotSurface{Name: surface.name}
+
+		visitVariantDepsWithTag(surfaceDepTag{surface: surface.name}, func(dep android.Module) {
+			if provider, ok := dep.(interface{ HeaderJars() android.Paths }); ok {
+				if jars := provider.HeaderJars(); len(jars) > 0 {
+					snap.StubJar = jars[0]
+				}
+			}
+		})
+		if snap.StubJar == nil {
+			moduleCtx.ModuleErrorf("%s surface aggregator %q produced no header jars to snapshot",
+				surface.name, surface.stubsModule)
+		}
+
+		visitVariantDepsWithTag(surfaceDepTag{surface: surface.name, docs: true}, func(dep android.Module) {
+			if provider, ok := dep.(interface{ ApiFilePath() android.Path }); ok {
+				snap.ApiFile = provider.ApiFilePath()
+			}
+		})
+
+		p.Surfaces = append(p.Surfaces, snap)
+	}
+}
+
+// AddToPropertySet regenerates a `combined_apis_import` entry in the
+// snapshot's Android.bp, with one nested property set per surface pointing at
+// the prebuilt stub jar and api txt file copied into the snapshot zip.
+func (p *combinedApisSdkMemberProperties) AddToPropertySet(ctx android.SdkMemberContext, propertySet android.BpPropertySet) {
+	if len(p.Bootclasspath) > 0 {
+		propertySet.AddProperty("bootclasspath", p.Bootclasspath)
+	}
+	if len(p.System_server_classpath) > 0 {
+		propertySet.AddProperty("system_server_classpath", p.System_server_classpath)
+	}
+
+	builder := ctx.SnapshotBuilder()
+	for _, surface := range p.Surfaces {
+		if surface.StubJar == nil && surface.ApiFile == nil {
+			continue
+		}
+
+		surfaceSet := propertySet.AddPropertySet(bpSurfaceName(surface.Name))
+		if surface.StubJar != nil {
+			dest := surface.Name + "/stubs.jar"
+			builder.CopyToSnapshot(surface.StubJar, dest)
+			surfaceSet.AddProperty("stub_jar", dest)
+		}
+		if surface.ApiFile != nil {
+			dest := surface.Name + "/api/current.txt"
+			builder.CopyToSnapshot(surface.ApiFile, dest)
+			surfaceSet.AddProperty("api_file", dest)
+		}
+	}
+}
+
+// bpSurfaceName converts a surface's display name (e.g. "module-lib",
+// "system-server") into the underscored form blueprint property/field names
+// require (e.g. "module_lib", "system_server").
+func bpSurfaceName(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// SurfaceImportProperties is a single surface's prebuilt stub jar and api txt
+// file, as referenced from CombinedApisImportProperties.
+type SurfaceImportProperties struct {
+	Stub_jar *string
+	Api_file *string
+}
+
+// CombinedApisImportProperties is the bp-visible shape of the
+// combined_apis_import prebuilt regenerated by AddToPropertySet: the same
+// classpath lists as combined_apis, plus one nested surface block per API
+// surface pointing at its prebuilt stub jar and api txt file.
+type CombinedApisImportProperties struct {
+	Bootclasspath            []string
+	System_server_classpath []string
+
+	Public        SurfaceImportProperties
+	System        SurfaceImportProperties
+	Test          SurfaceImportProperties
+	Module_lib    SurfaceImportProperties
+	System_server SurfaceImportProperties
+}
+
+// CombinedApisImport is the prebuilt counterpart of CombinedApis produced by
+// sdk snapshots: it carries the prebuilt stub jars and api files forward
+// as-is instead of regenerating them from source droidstubs.
+type CombinedApisImport struct {
+	android.ModuleBase
+	prebuilt android.Prebuilt
+
+	properties CombinedApisImportProperties
+}
+
+func (a *CombinedApisImport) Prebuilt() *android.Prebuilt {
+	return &a.prebuilt
+}
+
+func (a *CombinedApisImport) Name() string {
+	return a.prebuilt.Name(a.ModuleBase.Name())
+}
+
+func (a *CombinedApisImport) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	// The prebuilt jars/api files are referenced directly from the snapshot's
+	// surface property sets by their consumers; there is nothing further to
+	// build here.
+}
+
+func combinedApisImportModuleFactory() android.Module {
+	module := &CombinedApisImport{}
+	module.AddProperties(&module.properties)
+	android.InitPrebuiltModule(module, &[]string{""})
+	android.InitAndroidModule(module)
+	return module
+}